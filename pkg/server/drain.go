@@ -0,0 +1,63 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package server
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// distSQLDrainTimeout bounds how long (*adminServer).Drain waits for flows
+// already registered in the distsqlrun flow registry to finish.
+const distSQLDrainTimeout = 10 * time.Second
+
+// drainDistSQL puts this node's distsqlrun server into a draining state and
+// waits (up to distSQLDrainTimeout) for its already-registered flows to
+// finish. (*adminServer).Drain calls it so that "cockroach quit" gives
+// in-flight distributed SQL work a chance to complete.
+func (s *Server) drainDistSQL(ctx context.Context) {
+	s.distSQLServer.Drain(ctx, distSQLDrainTimeout)
+}
+
+// Drain implements the Admin service's Drain RPC (see admin.proto). This is
+// the entrypoint "cockroach quit" calls to put the node into a draining
+// state ahead of shutdown.
+//
+// It drains only the distsqlrun server (see drainDistSQL) and returns once
+// that is done or has timed out; it does not drain SQL connections or
+// transfer leases.
+func (s *adminServer) Drain(
+	ctx context.Context, req *serverpb.DrainRequest,
+) (*serverpb.DrainResponse, error) {
+	s.server.drainDistSQL(ctx)
+	log.Info(ctx, "drain: distsqlrun flows drained")
+	return &serverpb.DrainResponse{}, nil
+}
+
+// DrainDistSQL implements the Admin service's DrainDistSQL RPC (see
+// admin.proto). It lets an operator, or the CLI driving "cockroach quit",
+// poll distsql drain progress while Drain is still waiting.
+func (s *adminServer) DrainDistSQL(
+	ctx context.Context, req *serverpb.DrainDistSQLRequest,
+) (*serverpb.DrainDistSQLResponse, error) {
+	return &serverpb.DrainDistSQLResponse{
+		Draining:       s.server.distSQLServer.IsDraining(),
+		NumActiveFlows: int64(s.server.distSQLServer.NumFlows()),
+	}, nil
+}
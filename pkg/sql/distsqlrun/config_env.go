@@ -0,0 +1,84 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// envConfig holds distsqlrun runtime knobs that operators can tune in-place,
+// at node startup, without a cluster setting round-trip. It is populated
+// once by ServerConfig.readEnvironmentVariables and consulted by NewServer
+// and the rest of ServerImpl.
+//
+// This mirrors the pattern used by base.Config.readEnvironmentVariables for
+// the KV layer. COCKROACH_NOTEWORTHY_DISTSQL_MEMORY_USAGE, which predates
+// envConfig, is folded in here as NoteworthyMemoryUsageBytes rather than
+// left as a standalone package var.
+type envConfig struct {
+	// UseTempStorage is an override for sql.defaults.distsql.tempstorage:
+	// if set, it forces DistSQL processors to be allowed to spill to disk
+	// regardless of the cluster setting. Unset (false, the default), it
+	// does not disable temp storage -- NewServer follows the cluster
+	// setting's value at the time NewServer runs; a later change to the
+	// setting is not picked up.
+	UseTempStorage bool
+	// MaxConcurrentFlows caps the number of concurrently running flows per
+	// FlowPriority class in the flowScheduler.
+	MaxConcurrentFlows int
+	// FlowStreamTimeout bounds how long FlowStream waits for a flow to
+	// register itself in the flowRegistry before giving up on an inbound
+	// stream connection.
+	FlowStreamTimeout time.Duration
+	// MemoryLimitBytes, if nonzero, gives the distsql memory monitor a fixed
+	// budget instead of borrowing headroom from ParentMemoryMonitor.
+	MemoryLimitBytes int64
+	// MinAcceptedVersion lets an operator force this node to reject older
+	// protocol versions than MinAcceptedVersion would otherwise allow, e.g.
+	// to finish draining a rolling upgrade.
+	MinAcceptedVersion int32
+	// NoteworthyMemoryUsageBytes is the threshold, in bytes, above which
+	// the distsql memory monitors log usage; see mon.MakeMonitor.
+	NoteworthyMemoryUsageBytes int64
+}
+
+// readEnvironmentVariables populates an envConfig from COCKROACH_* env vars,
+// falling back to the existing defaults (cluster setting defaults and
+// package constants) when a variable isn't set. It logs the effective
+// configuration so operators can confirm an override took effect.
+func (cfg *ServerConfig) readEnvironmentVariables() envConfig {
+	env := envConfig{
+		UseTempStorage: envutil.EnvOrDefaultBool(
+			"COCKROACH_DISTSQL_TEMP_STORAGE", false),
+		MaxConcurrentFlows: envutil.EnvOrDefaultInt(
+			"COCKROACH_DISTSQL_MAX_CONCURRENT_FLOWS", defaultMaxRunningFlowsPerClass),
+		FlowStreamTimeout: envutil.EnvOrDefaultDuration(
+			"COCKROACH_DISTSQL_FLOW_STREAM_TIMEOUT", flowStreamDefaultTimeout),
+		MemoryLimitBytes: envutil.EnvOrDefaultInt64(
+			"COCKROACH_DISTSQL_MEMORY_LIMIT", 0),
+		MinAcceptedVersion: int32(envutil.EnvOrDefaultInt(
+			"COCKROACH_DISTSQL_MIN_ACCEPTED_VERSION", MinAcceptedVersion)),
+		NoteworthyMemoryUsageBytes: envutil.EnvOrDefaultInt64(
+			"COCKROACH_NOTEWORTHY_DISTSQL_MEMORY_USAGE", 10*1024),
+	}
+	log.Infof(cfg.AnnotateCtx(context.Background()),
+		"distsqlrun: effective runtime config: %+v", env)
+	return env
+}
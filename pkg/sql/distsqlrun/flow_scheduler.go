@@ -0,0 +1,365 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/mon"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// FlowPriority classifies a flow for the purposes of scheduling and
+// admission control. Queued flows of a higher priority are considered for
+// admission ahead of queued flows of a lower priority, though a higher
+// priority flow can never preempt a flow that is already running.
+//
+// The zero value is FlowPriorityInteractive. A SetupFlowRequest whose
+// Priority field is left unset reads as 0 and so is also scheduled as
+// FlowPriorityInteractive (see flowPriorityFromRequest).
+type FlowPriority int32
+
+const (
+	// FlowPriorityInteractive is for latency-sensitive flows, typically
+	// small OLTP-style queries issued by an interactive client. These are
+	// scheduled ahead of everything else.
+	FlowPriorityInteractive FlowPriority = iota
+	// FlowPriorityNormal is the default priority.
+	FlowPriorityNormal
+	// FlowPriorityBatch is for throughput-oriented flows (large analytical
+	// scans, backups, etc.) that can tolerate queueing behind interactive
+	// and normal traffic.
+	FlowPriorityBatch
+
+	numFlowPriorities = int(FlowPriorityBatch) + 1
+)
+
+// defaultMaxRunningFlowsPerClass is the default soft cap on the number of
+// concurrently running flows of a given FlowPriority. It is deliberately
+// generous; the memory monitor is the primary admission gate and this cap
+// mostly exists to keep a burst of cheap flows from starving the scheduler's
+// bookkeeping.
+const defaultMaxRunningFlowsPerClass = 500
+
+// defaultMaxQueuedFlowsPerClass bounds how many flows of a given
+// FlowPriority can wait for admission at once. Once a class's queue is full,
+// ScheduleFlow rejects new flows outright instead of queueing them
+// indefinitely -- this is what actually makes admission control effective
+// under sustained overload, as opposed to just delaying the inevitable.
+const defaultMaxQueuedFlowsPerClass = 128
+
+// schedulableFlow is the subset of *Flow's interface that flowScheduler
+// needs in order to run an admitted flow. It's kept narrow (rather than
+// depending on *Flow directly) so tests can exercise admission control with
+// a lightweight fake instead of standing up a real Flow.
+type schedulableFlow interface {
+	// Start runs the flow's goroutines and calls doneFn once the flow has
+	// completed, so the scheduler can release its slot.
+	Start(ctx context.Context, doneFn func())
+}
+
+// flowSchedulerMetrics are the metrics maintained by a flowScheduler. Any of
+// these may be nil (e.g. in tests, or if a caller hasn't been updated to
+// register them on ServerConfig yet); all uses below must be nil-safe.
+type flowSchedulerMetrics struct {
+	QueueDepth    *metric.Gauge
+	AdmissionWait *metric.Histogram
+	RejectionCnt  *metric.Counter
+}
+
+func (m flowSchedulerMetrics) updateQueueDepth(depth int64) {
+	if m.QueueDepth != nil {
+		m.QueueDepth.Update(depth)
+	}
+}
+
+func (m flowSchedulerMetrics) recordAdmissionWait(d time.Duration) {
+	if m.AdmissionWait != nil {
+		m.AdmissionWait.RecordValue(d.Nanoseconds())
+	}
+}
+
+func (m flowSchedulerMetrics) incRejections(n int64) {
+	if m.RejectionCnt != nil {
+		m.RejectionCnt.Inc(n)
+	}
+}
+
+// makeFlowSchedulerMetrics wraps the caller-registered metrics from
+// ServerConfig for use by a flowScheduler. The metrics themselves are
+// created and registered by the caller, alongside ServerConfig.Counter and
+// ServerConfig.Hist; a caller that hasn't been updated to set them yields a
+// flowSchedulerMetrics of all nils, which is handled gracefully above.
+func makeFlowSchedulerMetrics(cfg ServerConfig) flowSchedulerMetrics {
+	return flowSchedulerMetrics{
+		QueueDepth:    cfg.FlowSchedulerQueueDepth,
+		AdmissionWait: cfg.FlowSchedulerAdmissionWait,
+		RejectionCnt:  cfg.FlowSchedulerRejections,
+	}
+}
+
+// FlowSchedulerTestingKnobs are testing hooks for flowScheduler.
+type FlowSchedulerTestingKnobs struct {
+	// OverrideAdmissionDecision, if set, is consulted instead of the normal
+	// memory-headroom check. It lets tests force a flow to be admitted or
+	// queued/rejected deterministically, regardless of actual memory
+	// pressure.
+	OverrideAdmissionDecision func(priority FlowPriority, memEstimate int64) (admit bool)
+}
+
+// flowPriorityFromRequest maps the wire-level priority on a
+// SetupFlowRequest (see api.proto) to a FlowPriority. An unset field reads
+// as 0 and so maps to FlowPriorityInteractive; values outside the known
+// range map to FlowPriorityNormal.
+func flowPriorityFromRequest(p int32) FlowPriority {
+	if p < int32(FlowPriorityInteractive) || p > int32(FlowPriorityBatch) {
+		return FlowPriorityNormal
+	}
+	return FlowPriority(p)
+}
+
+// pendingFlow is an entry in one of the flowScheduler's per-priority queues.
+type pendingFlow struct {
+	f           schedulableFlow
+	memEstimate int64
+	enqueued    time.Time
+	readyCh     chan error
+}
+
+// flowScheduler manages running flows and decides when to execute them. Each
+// flow is assigned a FlowPriority (derived from SetupFlowRequest.Priority)
+// and is queued in the corresponding class until it can be admitted.
+//
+// Admission is gated on two things:
+//   - a soft per-class cap on the number of concurrently running flows, and
+//   - the flow's estimated memory footprint fitting in the headroom
+//     remaining in the server's memory monitor.
+//
+// Within a class, queued flows are admitted in FIFO order. A flow arriving
+// in ScheduleFlow is not queued at all if it can be admitted right away, so
+// it may start ahead of flows (of any class) that are already queued, e.g.
+// ones whose memory estimate did not fit. Across classes, a newly
+// freed slot is always offered to the highest-priority non-empty queue
+// first, so a queued Interactive flow effectively preempts the queue
+// position of Batch flows that arrived earlier -- but a flow that is already
+// running is never preempted. Each class's queue is itself bounded
+// (maxQueued); once full, ScheduleFlow rejects new flows immediately rather
+// than queueing them forever.
+type flowScheduler struct {
+	log.AmbientContext
+	stopper    *stop.Stopper
+	memMonitor *mon.MemoryMonitor
+	metrics    flowSchedulerMetrics
+	knobs      FlowSchedulerTestingKnobs
+
+	maxRunning [numFlowPriorities]int
+	maxQueued  [numFlowPriorities]int
+
+	mu struct {
+		syncutil.Mutex
+		queues  [numFlowPriorities][]*pendingFlow
+		running [numFlowPriorities]int
+	}
+}
+
+func newFlowScheduler(
+	ambient log.AmbientContext,
+	stopper *stop.Stopper,
+	memMonitor *mon.MemoryMonitor,
+	metrics flowSchedulerMetrics,
+) *flowScheduler {
+	fs := &flowScheduler{
+		AmbientContext: ambient,
+		stopper:        stopper,
+		memMonitor:     memMonitor,
+		metrics:        metrics,
+	}
+	for i := range fs.maxRunning {
+		fs.maxRunning[i] = defaultMaxRunningFlowsPerClass
+		fs.maxQueued[i] = defaultMaxQueuedFlowsPerClass
+	}
+	return fs
+}
+
+// Start launches a worker that, on stopper quiescence, unblocks any flow
+// still waiting in a queue so it doesn't hang forever.
+func (fs *flowScheduler) Start() {
+	fs.stopper.RunWorker(context.Background(), func(ctx context.Context) {
+		<-fs.stopper.ShouldStop()
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		for p, q := range fs.mu.queues {
+			for _, pf := range q {
+				pf.readyCh <- errors.Errorf("flow scheduler stopped")
+			}
+			fs.mu.queues[p] = nil
+		}
+		fs.metrics.updateQueueDepth(0)
+	})
+}
+
+// tryAdmitLocked attempts to admit a flow of the given priority and memory
+// estimate. It returns true if admitted, in which case the class's running
+// count has already been bumped. fs.mu must be held.
+func (fs *flowScheduler) tryAdmitLocked(priority FlowPriority, memEstimate int64) bool {
+	if fs.mu.running[priority] >= fs.maxRunning[priority] {
+		return false
+	}
+	if fs.knobs.OverrideAdmissionDecision != nil {
+		if !fs.knobs.OverrideAdmissionDecision(priority, memEstimate) {
+			return false
+		}
+	} else if fs.memMonitor != nil && memEstimate > 0 {
+		// Probe the monitor for headroom without permanently reserving the
+		// estimate: the flow's own monitor (set up in
+		// ServerImpl.setupFlow) will account for its actual usage.
+		acc := fs.memMonitor.MakeBoundAccount()
+		ctx := fs.AnnotateCtx(context.Background())
+		if err := acc.Grow(ctx, memEstimate); err != nil {
+			return false
+		}
+		acc.Close(ctx)
+	}
+	fs.mu.running[priority]++
+	return true
+}
+
+// ScheduleFlow is called by ServerImpl.SetupFlow to admit (or queue) a flow
+// of the given priority/memory estimate for execution. It blocks until the
+// flow is admitted, rejected (the class's queue is full, or ctx is done), or
+// the scheduler is stopped, then starts the flow's goroutines.
+func (fs *flowScheduler) ScheduleFlow(
+	ctx context.Context, f schedulableFlow, priority FlowPriority, memEstimate int64,
+) error {
+	fs.mu.Lock()
+	if fs.tryAdmitLocked(priority, memEstimate) {
+		fs.mu.Unlock()
+		return fs.startFlow(ctx, f, priority)
+	}
+	if len(fs.mu.queues[priority]) >= fs.maxQueued[priority] {
+		fs.mu.Unlock()
+		fs.metrics.incRejections(1)
+		return errors.Errorf(
+			"flow scheduler: %d priority queue is full (%d flows already queued)",
+			priority, fs.maxQueued[priority],
+		)
+	}
+	pf := &pendingFlow{
+		f: f, memEstimate: memEstimate, enqueued: timeutil.Now(), readyCh: make(chan error, 1),
+	}
+	fs.mu.queues[priority] = append(fs.mu.queues[priority], pf)
+	fs.refreshQueueDepthMetricLocked()
+	fs.mu.Unlock()
+
+	select {
+	case err := <-pf.readyCh:
+		fs.metrics.recordAdmissionWait(timeutil.Since(pf.enqueued))
+		if err != nil {
+			fs.metrics.incRejections(1)
+			return err
+		}
+		return fs.startFlow(ctx, f, priority)
+	case <-ctx.Done():
+		if fs.removeQueuedLocked(priority, pf) {
+			fs.metrics.recordAdmissionWait(timeutil.Since(pf.enqueued))
+			fs.metrics.incRejections(1)
+			return ctx.Err()
+		}
+		// Lost the race: flowDone already admitted pf (or the stopper is
+		// quiescing) before we could cancel it out of the queue. Honor that
+		// outcome instead of leaking the running slot it reserved.
+		err := <-pf.readyCh
+		fs.metrics.recordAdmissionWait(timeutil.Since(pf.enqueued))
+		if err != nil {
+			fs.metrics.incRejections(1)
+			return err
+		}
+		return fs.startFlow(ctx, f, priority)
+	}
+}
+
+// removeQueuedLocked removes pf from priority's queue if it's still there,
+// returning whether it did. It returns false if pf was already admitted (or
+// dropped on scheduler shutdown) concurrently, which is possible since
+// ScheduleFlow's ctx.Done() case races with flowDone picking pf off the
+// queue.
+func (fs *flowScheduler) removeQueuedLocked(priority FlowPriority, pf *pendingFlow) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	q := fs.mu.queues[priority]
+	for i, queued := range q {
+		if queued == pf {
+			fs.mu.queues[priority] = append(q[:i], q[i+1:]...)
+			fs.refreshQueueDepthMetricLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// refreshQueueDepthMetricLocked refreshes the queue depth gauge to reflect
+// the total number of flows currently queued across all classes. fs.mu must
+// be held.
+func (fs *flowScheduler) refreshQueueDepthMetricLocked() {
+	var depth int64
+	for _, q := range fs.mu.queues {
+		depth += int64(len(q))
+	}
+	fs.metrics.updateQueueDepth(depth)
+}
+
+// startFlow starts the flow's goroutines; once it completes, the scheduling
+// slot is released and the next queued flow (if any) is admitted.
+func (fs *flowScheduler) startFlow(ctx context.Context, f schedulableFlow, priority FlowPriority) error {
+	err := fs.stopper.RunTask(ctx, "distsqlrun.flowScheduler: running flow", func(ctx context.Context) {
+		f.Start(ctx, func() { fs.flowDone(priority) })
+	})
+	if err != nil {
+		// The flow never started, so it will never call back into
+		// flowDone; release its slot ourselves.
+		fs.flowDone(priority)
+	}
+	return err
+}
+
+// flowDone releases a running slot for priority and admits the next queued
+// flow from the highest-priority non-empty class, if any.
+func (fs *flowScheduler) flowDone(priority FlowPriority) {
+	fs.mu.Lock()
+	fs.mu.running[priority]--
+	for p := 0; p < numFlowPriorities; p++ {
+		q := fs.mu.queues[p]
+		if len(q) == 0 {
+			continue
+		}
+		pf := q[0]
+		if !fs.tryAdmitLocked(FlowPriority(p), pf.memEstimate) {
+			continue
+		}
+		fs.mu.queues[p] = q[1:]
+		fs.refreshQueueDepthMetricLocked()
+		fs.mu.Unlock()
+		pf.readyCh <- nil
+		return
+	}
+	fs.mu.Unlock()
+}
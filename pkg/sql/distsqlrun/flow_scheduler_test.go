@@ -0,0 +1,195 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package distsqlrun
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/testutils"
+)
+
+// fakeSchedulableFlow is a minimal schedulableFlow that completes
+// synchronously, so tests can drive flowScheduler's admission and
+// run-to-completion path without a real Flow.
+type fakeSchedulableFlow struct {
+	started int32
+}
+
+func (f *fakeSchedulableFlow) Start(ctx context.Context, doneFn func()) {
+	atomic.StoreInt32(&f.started, 1)
+	doneFn()
+}
+
+func newTestFlowScheduler(stopper *stop.Stopper) *flowScheduler {
+	return newFlowScheduler(log.AmbientContext{}, stopper, nil /* memMonitor */, flowSchedulerMetrics{})
+}
+
+// TestFlowSchedulerOverrideAdmissionDecision verifies that the
+// OverrideAdmissionDecision testing knob deterministically controls
+// admission: forcing it off causes ScheduleFlow to reject (rather than
+// block forever) once the caller gives up, and forcing it on causes the
+// flow to actually be started.
+func TestFlowSchedulerOverrideAdmissionDecision(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	defer stopper.Stop(context.Background())
+	fs := newTestFlowScheduler(stopper)
+
+	fs.knobs.OverrideAdmissionDecision = func(FlowPriority, int64) bool { return false }
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f := &fakeSchedulableFlow{}
+	if err := fs.ScheduleFlow(canceledCtx, f, FlowPriorityNormal, 0); err == nil {
+		t.Fatal("expected ScheduleFlow to reject once its context is done and admission is forced off")
+	}
+	if atomic.LoadInt32(&f.started) != 0 {
+		t.Fatal("flow should not have been started while admission is forced off")
+	}
+
+	fs.knobs.OverrideAdmissionDecision = func(FlowPriority, int64) bool { return true }
+	f = &fakeSchedulableFlow{}
+	if err := fs.ScheduleFlow(context.Background(), f, FlowPriorityNormal, 0); err != nil {
+		t.Fatalf("expected ScheduleFlow to admit the flow, got: %v", err)
+	}
+	if atomic.LoadInt32(&f.started) != 1 {
+		t.Fatal("expected the admitted flow to have been started")
+	}
+}
+
+// TestFlowSchedulerBoundedQueue verifies that once a class's queue is full,
+// ScheduleFlow rejects further flows outright instead of queueing them
+// indefinitely. The RejectionCnt metric is not checked here.
+func TestFlowSchedulerBoundedQueue(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	fs := newTestFlowScheduler(stopper)
+	fs.Start()
+
+	fs.knobs.OverrideAdmissionDecision = func(FlowPriority, int64) bool { return false }
+	fs.maxQueued[FlowPriorityBatch] = 2
+
+	errCh := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errCh <- fs.ScheduleFlow(context.Background(), &fakeSchedulableFlow{}, FlowPriorityBatch, 0)
+		}()
+	}
+	testutils.SucceedsSoon(t, func() error {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if len(fs.mu.queues[FlowPriorityBatch]) != 2 {
+			return errors.Errorf("expected 2 queued flows, got %d", len(fs.mu.queues[FlowPriorityBatch]))
+		}
+		return nil
+	})
+
+	if err := fs.ScheduleFlow(
+		context.Background(), &fakeSchedulableFlow{}, FlowPriorityBatch, 0,
+	); err == nil {
+		t.Fatal("expected the third flow to be rejected once the queue is full")
+	}
+
+	// Quiescing the stopper unblocks the two flows still waiting in the
+	// queue instead of leaking their goroutines past the test.
+	stopper.Stop(context.Background())
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err == nil {
+			t.Fatal("expected queued flows to be rejected on scheduler shutdown")
+		}
+	}
+}
+
+// TestFlowSchedulerPriorityOrdering verifies that when a running slot frees
+// up, the scheduler offers it to the highest-priority non-empty queue even
+// if a lower-priority flow was queued first.
+func TestFlowSchedulerPriorityOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	stopper := stop.NewStopper()
+	fs := newTestFlowScheduler(stopper)
+	fs.Start()
+
+	// Admission stays blocked until the test opens it, and then admits
+	// exactly one flow before blocking again.
+	blockAdmission := int32(1)
+	fs.knobs.OverrideAdmissionDecision = func(FlowPriority, int64) bool {
+		return atomic.CompareAndSwapInt32(&blockAdmission, 0, 1)
+	}
+
+	var mu syncutil.Mutex
+	var admitted []FlowPriority
+	schedule := func(p FlowPriority, done chan<- struct{}) {
+		_ = fs.ScheduleFlow(context.Background(), &fakeSchedulableFlow{}, p, 0)
+		mu.Lock()
+		admitted = append(admitted, p)
+		mu.Unlock()
+		close(done)
+	}
+
+	batchDone := make(chan struct{})
+	go schedule(FlowPriorityBatch, batchDone)
+	testutils.SucceedsSoon(t, func() error {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if len(fs.mu.queues[FlowPriorityBatch]) != 1 {
+			return errors.Errorf("batch flow not queued yet")
+		}
+		return nil
+	})
+
+	interactiveDone := make(chan struct{})
+	go schedule(FlowPriorityInteractive, interactiveDone)
+	testutils.SucceedsSoon(t, func() error {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if len(fs.mu.queues[FlowPriorityInteractive]) != 1 {
+			return errors.Errorf("interactive flow not queued yet")
+		}
+		return nil
+	})
+
+	// Pretend a single slot just freed up: allow admission and replay the
+	// dispatch logic. The Interactive flow queued second should still win.
+	atomic.StoreInt32(&blockAdmission, 0)
+	fs.flowDone(FlowPriorityInteractive)
+
+	select {
+	case <-interactiveDone:
+	case <-time.After(testutils.DefaultSucceedsSoonDuration):
+		t.Fatal("interactive flow was never admitted")
+	}
+
+	mu.Lock()
+	if len(admitted) != 1 || admitted[0] != FlowPriorityInteractive {
+		mu.Unlock()
+		t.Fatalf("expected Interactive to be admitted first, got %v", admitted)
+	}
+	mu.Unlock()
+
+	// Let the batch flow drain on teardown instead of leaking.
+	stopper.Stop(context.Background())
+	<-batchDone
+}
@@ -31,14 +31,15 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/rpc"
 	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/mon"
 	"github.com/cockroachdb/cockroach/pkg/sql/parser"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/storage/engine"
-	"github.com/cockroachdb/cockroach/pkg/util/envutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/tracing"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 )
@@ -72,14 +73,17 @@ const Version = 4
 // compatible with; see above.
 const MinAcceptedVersion = 4
 
+// SetupFlowRequest.Priority and SetupFlowRequest.MemEstimate (added in
+// api.proto alongside this change) let the planner classify a flow for the
+// purposes of admission control; see flowPriorityFromRequest and
+// flowScheduler.
+
 var distSQLUseTempStorage = settings.RegisterBoolSetting(
 	"sql.defaults.distsql.tempstorage",
 	"set to true to enable use of disk for larger distributed sql queries",
 	false,
 )
 
-var noteworthyMemoryUsageBytes = envutil.EnvOrDefaultInt64("COCKROACH_NOTEWORTHY_DISTSQL_MEMORY_USAGE", 10*1024)
-
 // ServerConfig encompasses the configuration required to create a
 // DistSQLServer.
 type ServerConfig struct {
@@ -96,10 +100,29 @@ type ServerConfig struct {
 	Stopper      *stop.Stopper
 	TestingKnobs TestingKnobs
 
+	// Settings is used to consult the value of cluster settings, such
+	// as sql.defaults.distsql.tempstorage, that readEnvironmentVariables'
+	// env overrides layer on top of rather than replace.
+	Settings *cluster.Settings
+
 	ParentMemoryMonitor *mon.MemoryMonitor
 	Counter             *metric.Counter
 	Hist                *metric.Histogram
 
+	// FlowSchedulerQueueDepth, FlowSchedulerAdmissionWait and
+	// FlowSchedulerRejections are registered by the caller alongside
+	// Counter/Hist and are wired into the flowScheduler's admission control
+	// queue by NewServer.
+	FlowSchedulerQueueDepth    *metric.Gauge
+	FlowSchedulerAdmissionWait *metric.Histogram
+	FlowSchedulerRejections    *metric.Counter
+
+	// NumActiveFlows is registered by the caller alongside Counter/Hist and
+	// tracks the number of flows currently registered in flowRegistry. It is
+	// kept up to date by the worker ServerImpl.Start launches, and also
+	// refreshed by ServerImpl.Drain while it polls flowRegistry.
+	NumActiveFlows *metric.Gauge
+
 	// TempStorage is used by some DistSQL processors to store rows when the
 	// working set is larger than can be stored in memory. It can be nil, if this
 	// cockroach node does not have an engine for temporary storage.
@@ -136,29 +159,142 @@ type ServerImpl struct {
 	// tempStorageIDGenerator is used to generate unique prefixes per processor so that
 	// each processor uses a nonoverlapping part of the temp keyspace.
 	tempStorageIDGenerator TempStorageIDGenerator
+	// envConfig holds the effective COCKROACH_DISTSQL_* runtime overrides
+	// computed once at startup; see ServerConfig.readEnvironmentVariables.
+	envConfig envConfig
+	// draining is set to 1 once Drain has been called; SetupFlow and
+	// SetupSyncFlow consult it to reject new work. Accessed atomically.
+	draining int32
 }
 
 var _ DistSQLServer = &ServerImpl{}
 
 // NewServer instantiates a DistSQLServer.
 func NewServer(ctx context.Context, cfg ServerConfig) *ServerImpl {
+	env := cfg.readEnvironmentVariables()
 	ds := &ServerImpl{
-		ServerConfig:  cfg,
-		regexpCache:   parser.NewRegexpCache(512),
-		flowRegistry:  makeFlowRegistry(),
-		flowScheduler: newFlowScheduler(cfg.AmbientContext, cfg.Stopper),
+		ServerConfig: cfg,
+		regexpCache:  parser.NewRegexpCache(512),
+		flowRegistry: makeFlowRegistry(),
 		memMonitor: mon.MakeMonitor("distsql",
-			cfg.Counter, cfg.Hist, -1 /* increment: use default block size */, noteworthyMemoryUsageBytes),
+			cfg.Counter, cfg.Hist, -1 /* increment: use default block size */, env.NoteworthyMemoryUsageBytes),
 		tempStorage:            cfg.TempStorage,
 		tempStorageIDGenerator: TempStorageIDGenerator{},
+		envConfig:              env,
+	}
+	// The env var is an override, not a replacement: a node that leaves
+	// COCKROACH_DISTSQL_TEMP_STORAGE unset follows the cluster setting's
+	// value as read here. The setting is read only once; enabling it later
+	// does not give this server back the temp storage dropped here.
+	useTempStorage := env.UseTempStorage
+	if cfg.Settings != nil {
+		useTempStorage = useTempStorage || distSQLUseTempStorage.Get(&cfg.Settings.SV)
+	}
+	if !useTempStorage {
+		ds.tempStorage = nil
+	}
+	if env.MemoryLimitBytes > 0 {
+		ds.memMonitor.Start(ctx, nil /* parent */, mon.MakeStandaloneBudget(env.MemoryLimitBytes))
+	} else {
+		ds.memMonitor.Start(ctx, cfg.ParentMemoryMonitor, mon.BoundAccount{})
+	}
+	ds.flowScheduler = newFlowScheduler(
+		cfg.AmbientContext, cfg.Stopper, &ds.memMonitor, makeFlowSchedulerMetrics(cfg),
+	)
+	ds.flowScheduler.knobs = cfg.TestingKnobs.FlowScheduler
+	if env.MaxConcurrentFlows > 0 {
+		for i := range ds.flowScheduler.maxRunning {
+			ds.flowScheduler.maxRunning[i] = env.MaxConcurrentFlows
+		}
 	}
-	ds.memMonitor.Start(ctx, cfg.ParentMemoryMonitor, mon.BoundAccount{})
 	return ds
 }
 
 // Start launches workers for the server.
 func (ds *ServerImpl) Start() {
 	ds.flowScheduler.Start()
+	if ds.NumActiveFlows != nil {
+		ds.Stopper.RunWorker(context.Background(), ds.reportActiveFlows)
+	}
+}
+
+// reportActiveFlows periodically refreshes the NumActiveFlows gauge from
+// flowRegistry until the stopper quiesces. Drain polls flowRegistry directly
+// rather than relying on this ticker's cadence.
+func (ds *ServerImpl) reportActiveFlows(ctx context.Context) {
+	ctx = ds.AnnotateCtx(ctx)
+	const reportInterval = time.Second
+	t := time.NewTicker(reportInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			ds.NumActiveFlows.Update(int64(ds.flowRegistry.NumFlows()))
+		case <-ds.Stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+// DrainingError is returned by SetupFlow and SetupSyncFlow once the server
+// has started draining (see ServerImpl.Drain). The gateway can type-assert
+// on it to distinguish a drain rejection from other flow setup failures and
+// retry the flow on a different node.
+type DrainingError struct{}
+
+// Error is part of the error interface.
+func (DrainingError) Error() string {
+	return "the server is draining and rejecting new flows"
+}
+
+// IsDraining returns whether the server has started draining. It backs the
+// "draining" boolean surfaced through the Admin service's DrainDistSQL RPC;
+// see (*adminServer).DrainDistSQL in pkg/server/drain.go.
+func (ds *ServerImpl) IsDraining() bool {
+	return atomic.LoadInt32(&ds.draining) != 0
+}
+
+// NumFlows returns the number of flows currently registered in the flow
+// registry. It backs the Admin service's DrainDistSQL RPC; see
+// (*adminServer).DrainDistSQL in pkg/server/drain.go.
+func (ds *ServerImpl) NumFlows() int {
+	return ds.flowRegistry.NumFlows()
+}
+
+// Drain puts the server into a draining state: SetupFlow and SetupSyncFlow
+// immediately start rejecting new requests with a DrainingError, while flows
+// already registered in flowRegistry keep running and their inbound
+// FlowStream connections continue to be accepted normally. Drain blocks
+// until flowRegistry reports zero active flows or timeout elapses, whichever
+// comes first.
+//
+// The caller -- typically the node's existing drain sequence invoked from
+// "cockroach quit" -- should call Drain before tearing down the stopper, so
+// in-flight distsql work has a chance to finish instead of being cut off
+// abruptly.
+func (ds *ServerImpl) Drain(ctx context.Context, timeout time.Duration) {
+	atomic.StoreInt32(&ds.draining, 1)
+
+	deadline := timeutil.Now().Add(timeout)
+	const pollInterval = 100 * time.Millisecond
+	for {
+		numFlows := ds.flowRegistry.NumFlows()
+		if ds.NumActiveFlows != nil {
+			ds.NumActiveFlows.Update(int64(numFlows))
+		}
+		if numFlows == 0 {
+			return
+		}
+		if timeutil.Now().After(deadline) {
+			log.Warningf(ctx, "distsqlrun: drain timed out with %d flows still active", numFlows)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
 }
 
 // Note: unless an error is returned, the returned context contains a span that
@@ -169,11 +305,17 @@ func (ds *ServerImpl) setupFlow(
 	req *SetupFlowRequest,
 	syncFlowConsumer RowReceiver,
 ) (context.Context, *Flow, error) {
-	if req.Version < MinAcceptedVersion ||
+	minAcceptedVersion := int32(MinAcceptedVersion)
+	if ds.envConfig.MinAcceptedVersion > minAcceptedVersion {
+		// COCKROACH_DISTSQL_MIN_ACCEPTED_VERSION lets an operator tighten
+		// this further, e.g. to finish draining a rolling upgrade.
+		minAcceptedVersion = ds.envConfig.MinAcceptedVersion
+	}
+	if int32(req.Version) < minAcceptedVersion ||
 		req.Version > Version {
 		err := errors.Errorf(
 			"version mismatch in flow request: %d; this node accepts %d through %d",
-			req.Version, MinAcceptedVersion, Version,
+			req.Version, minAcceptedVersion, Version,
 		)
 		log.Warning(ctx, err)
 		return ctx, nil, err
@@ -195,7 +337,7 @@ func (ds *ServerImpl) setupFlow(
 
 	// The monitor and account opened here are closed in Flow.Cleanup().
 	monitor := mon.MakeMonitor("flow",
-		ds.Counter, ds.Hist, -1 /* use default block size */, noteworthyMemoryUsageBytes)
+		ds.Counter, ds.Hist, -1 /* use default block size */, ds.envConfig.NoteworthyMemoryUsageBytes)
 	monitor.Start(ctx, &ds.memMonitor, mon.BoundAccount{})
 	acc := monitor.MakeBoundAccount()
 
@@ -261,6 +403,9 @@ func (ds *ServerImpl) setupFlow(
 func (ds *ServerImpl) SetupSyncFlow(
 	ctx context.Context, req *SetupFlowRequest, output RowReceiver,
 ) (context.Context, *Flow, error) {
+	if ds.IsDraining() {
+		return ctx, nil, DrainingError{}
+	}
 	return ds.setupFlow(ds.AnnotateCtx(ctx), opentracing.SpanFromContext(ctx), req, output)
 }
 
@@ -299,6 +444,9 @@ func (ds *ServerImpl) RunSyncFlow(stream DistSQL_RunSyncFlowServer) error {
 func (ds *ServerImpl) SetupFlow(
 	ctx context.Context, req *SetupFlowRequest,
 ) (*SimpleResponse, error) {
+	if ds.IsDraining() {
+		return &SimpleResponse{Error: NewError(DrainingError{})}, nil
+	}
 	parentSpan := opentracing.SpanFromContext(ctx)
 
 	// Note: the passed context will be canceled when this RPC completes, so we
@@ -306,7 +454,8 @@ func (ds *ServerImpl) SetupFlow(
 	ctx = ds.AnnotateCtx(context.Background())
 	ctx, f, err := ds.setupFlow(ctx, parentSpan, req, nil)
 	if err == nil {
-		err = ds.flowScheduler.ScheduleFlow(ctx, f)
+		priority := flowPriorityFromRequest(req.Priority)
+		err = ds.flowScheduler.ScheduleFlow(ctx, f, priority, req.MemEstimate)
 	}
 	if err != nil {
 		// We return flow deployment errors in the response so that they are
@@ -334,8 +483,12 @@ func (ds *ServerImpl) flowStreamInt(ctx context.Context, stream DistSQL_FlowStre
 	if log.V(1) {
 		log.Infof(ctx, "connecting inbound stream %s/%d", flowID.Short(), streamID)
 	}
+	streamTimeout := flowStreamDefaultTimeout
+	if ds.envConfig.FlowStreamTimeout > 0 {
+		streamTimeout = ds.envConfig.FlowStreamTimeout
+	}
 	f, receiver, cleanup, err := ds.flowRegistry.ConnectInboundStream(
-		ctx, flowID, streamID, flowStreamDefaultTimeout)
+		ctx, flowID, streamID, streamTimeout)
 	if err != nil {
 		return err
 	}
@@ -369,6 +522,11 @@ type TestingKnobs struct {
 	// executing the chunk. It is always called even when the backfill
 	// function returns an error, or if the table has already been dropped.
 	RunAfterBackfillChunk func()
+
+	// FlowScheduler contains testing knobs for the flowScheduler that let
+	// tests force deterministic admission control decisions instead of
+	// depending on actual memory pressure.
+	FlowScheduler FlowSchedulerTestingKnobs
 }
 
 // ModuleTestingKnobs is part of the base.ModuleTestingKnobs interface.